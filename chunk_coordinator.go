@@ -0,0 +1,73 @@
+package fluentd_forwarder
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"sync"
+	"time"
+)
+
+// ackTTL is how long a claim is extended for once its chunk has been
+// successfully imported. It must comfortably outlive any peer's
+// chunkClaimTTL so a slow-but-successful import can't have its claim
+// expire and be re-imported by a peer that lost the original race.
+const ackTTL = 24 * time.Hour
+
+type ChunkCoordinator interface {
+	Claim(chunkId string, ttl time.Duration) (bool, error)
+	Ack(chunkId string) error
+}
+
+type memoryChunkCoordinator struct {
+	mtx     sync.Mutex
+	claimed map[string]time.Time
+}
+
+func NewMemoryChunkCoordinator() ChunkCoordinator {
+	return &memoryChunkCoordinator{claimed: make(map[string]time.Time)}
+}
+
+func (c *memoryChunkCoordinator) Claim(chunkId string, ttl time.Duration) (bool, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if expiry, ok := c.claimed[chunkId]; ok && time.Now().Before(expiry) {
+		return false, nil
+	}
+	c.claimed[chunkId] = time.Now().Add(ttl)
+	return true, nil
+}
+
+func (c *memoryChunkCoordinator) Ack(chunkId string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.claimed[chunkId] = time.Now().Add(ackTTL)
+	return nil
+}
+
+type RedisChunkCoordinator struct {
+	client *redis.Client
+	prefix string
+}
+
+func NewRedisChunkCoordinator(addr, password string, db int, prefix string) *RedisChunkCoordinator {
+	return &RedisChunkCoordinator{
+		client: redis.NewClient(&redis.Options{Addr: addr, Password: password, DB: db}),
+		prefix: prefix,
+	}
+}
+
+func (c *RedisChunkCoordinator) claimKey(chunkId string) string {
+	return c.prefix + "claim." + chunkId
+}
+
+func (c *RedisChunkCoordinator) Claim(chunkId string, ttl time.Duration) (bool, error) {
+	return c.client.SetNX(context.Background(), c.claimKey(chunkId), "1", ttl).Result()
+}
+
+// Ack extends the same claim key's TTL rather than writing a separate
+// marker, since Claim only ever consults the claim key: a separate ack
+// key that nothing reads back doesn't stop a peer from re-claiming once
+// the original (short) claim TTL expires.
+func (c *RedisChunkCoordinator) Ack(chunkId string) error {
+	return c.client.Expire(context.Background(), c.claimKey(chunkId), ackTTL).Err()
+}
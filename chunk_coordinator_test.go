@@ -0,0 +1,62 @@
+package fluentd_forwarder
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryChunkCoordinatorNoDuplicateClaims(t *testing.T) {
+	c := NewMemoryChunkCoordinator()
+	const chunkId = "chunk-1"
+	const peers = 8
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	wins := 0
+	for i := 0; i < peers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			claimed, err := c.Claim(chunkId, 50*time.Millisecond)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if claimed {
+				mtx.Lock()
+				wins++
+				mtx.Unlock()
+				if err := c.Ack(chunkId); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if wins != 1 {
+		t.Fatalf("expected exactly one peer to win the claim, got %d", wins)
+	}
+}
+
+func TestMemoryChunkCoordinatorAckPreventsReclaimAfterOriginalTTL(t *testing.T) {
+	c := NewMemoryChunkCoordinator()
+	const chunkId = "chunk-2"
+	claimed, err := c.Claim(chunkId, 10*time.Millisecond)
+	if err != nil || !claimed {
+		t.Fatalf("expected initial claim to succeed, claimed=%v err=%v", claimed, err)
+	}
+	if err := c.Ack(chunkId); err != nil {
+		t.Fatalf("ack failed: %v", err)
+	}
+	// The original claim's short TTL has now elapsed, but Ack should have
+	// extended the same key well past it, so a losing peer retrying the
+	// claim after the original TTL must still be rejected.
+	time.Sleep(20 * time.Millisecond)
+	claimed, err = c.Claim(chunkId, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("claim failed: %v", err)
+	}
+	if claimed {
+		t.Fatalf("expected claim to be rejected after ack, got claimed=true")
+	}
+}
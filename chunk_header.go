@@ -0,0 +1,212 @@
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/ugorji/go/codec"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const chunkHeaderMagic uint32 = 0x54444648
+const chunkHeaderVersion1 uint8 = 1
+
+var ErrUnsupportedChunkHeaderVersion = errors.New("chunk header: unsupported version")
+var ErrBadChunkHeaderMagic = errors.New("chunk header: bad magic")
+
+type ChunkHeader struct {
+	Magic            uint32
+	Version          uint8
+	DatabaseName     string
+	TableName        string
+	RecordCount      int64
+	MinTimestamp     int64
+	MaxTimestamp     int64
+	UncompressedSize int64
+	PayloadSize      int64
+	Codec            string
+}
+
+// NewChunkHeader describes a record batch written to the journal.
+// uncompressedSize is the plain msgpack size, kept for monitoring/compression
+// ratio purposes; payloadSize is the number of bytes of Codec-compressed
+// data that actually follow the header on disk, which is what a reader
+// must strip off to get at the next frame.
+func NewChunkHeader(databaseName, tableName string, recordCount, minTimestamp, maxTimestamp, uncompressedSize, payloadSize int64, codecName string) *ChunkHeader {
+	return &ChunkHeader{
+		Magic:            chunkHeaderMagic,
+		Version:          chunkHeaderVersion1,
+		DatabaseName:     databaseName,
+		TableName:        tableName,
+		RecordCount:      recordCount,
+		MinTimestamp:     minTimestamp,
+		MaxTimestamp:     maxTimestamp,
+		UncompressedSize: uncompressedSize,
+		PayloadSize:      payloadSize,
+		Codec:            codecName,
+	}
+}
+
+func chunkHeaderHandle() *codec.MsgpackHandle {
+	h := &codec.MsgpackHandle{}
+	h.StructToArray = true
+	return h
+}
+
+func (h *ChunkHeader) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := codec.NewEncoder(&buf, chunkHeaderHandle())
+	if err := enc.Encode(h); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (h *ChunkHeader) UnmarshalBinary(data []byte) error {
+	dec := codec.NewDecoder(bytes.NewReader(data), chunkHeaderHandle())
+	if err := dec.Decode(h); err != nil {
+		return err
+	}
+	if h.Magic != chunkHeaderMagic {
+		return ErrBadChunkHeaderMagic
+	}
+	return nil
+}
+
+func WriteChunkHeader(w io.Writer, header *ChunkHeader) error {
+	data, err := header.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(data)))
+	if _, err := w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+const maxChunkHeaderSize = 64 * 1024
+
+func ReadChunkHeader(r io.Reader) (*ChunkHeader, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(lenBuf[:])
+	if size > maxChunkHeaderSize {
+		return nil, errors.New("chunk header: encoded size exceeds limit")
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	header := &ChunkHeader{}
+	if err := header.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	if header.Version != chunkHeaderVersion1 {
+		return header, ErrUnsupportedChunkHeaderVersion
+	}
+	return header, nil
+}
+
+func timestampRange(records []TinyFluentRecord) (min, max int64) {
+	for i, record := range records {
+		if i == 0 || record.Timestamp < min {
+			min = record.Timestamp
+		}
+		if i == 0 || record.Timestamp > max {
+			max = record.Timestamp
+		}
+	}
+	return min, max
+}
+
+// Recover scans journalGroupPath for chunk files left over from a
+// previous run and rebuilds the (database,table) -> spooler map from
+// their headers, rather than from the journal's file naming scheme.
+// Files whose header version is unrecognized are quarantined instead
+// of discarded, so a future version can still reprocess them.
+func (daemon *tdOutputSpoolerDaemon) Recover(journalGroupPath string) error {
+	infos, err := ioutil.ReadDir(journalGroupPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	quarantineDir := filepath.Join(journalGroupPath, "quarantine")
+	for _, info := range infos {
+		if info.IsDir() || filepath.Ext(info.Name()) != ".log" {
+			continue
+		}
+		if info.Size() == 0 {
+			continue
+		}
+		path := filepath.Join(journalGroupPath, info.Name())
+		header, err := readChunkHeaderFromFile(path)
+		if err != nil {
+			daemon.output.logger.Notice("Quarantining chunk file with unreadable header (%s): %s", err.Error(), path)
+			if qErr := quarantineFile(path, quarantineDir); qErr != nil {
+				daemon.output.logger.Error("Failed to quarantine %s: %s", path, qErr.Error())
+			}
+			continue
+		}
+		key := header.DatabaseName + "." + header.TableName
+		daemon.spawnSpooler(header.DatabaseName, header.TableName, key)
+	}
+	return nil
+}
+
+// headerStrippingReader strips the length-prefixed ChunkHeader that
+// precedes each record batch written by the emitter, exposing only the
+// concatenated Codec-compressed record payloads, so callers that need
+// the raw payload stream (e.g. the TD upload path) don't have to special
+// case the framing.
+type headerStrippingReader struct {
+	src io.Reader
+	buf bytes.Buffer
+}
+
+func newHeaderStrippingReader(src io.Reader) *headerStrippingReader {
+	return &headerStrippingReader{src: src}
+}
+
+func (r *headerStrippingReader) fill() error {
+	header, err := ReadChunkHeader(r.src)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(&r.buf, r.src, header.PayloadSize)
+	return err
+}
+
+func (r *headerStrippingReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	return r.buf.Read(p)
+}
+
+func readChunkHeaderFromFile(path string) (*ChunkHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadChunkHeader(f)
+}
+
+func quarantineFile(path, quarantineDir string) error {
+	if err := os.MkdirAll(quarantineDir, os.FileMode(0750)); err != nil {
+		return err
+	}
+	return os.Rename(path, filepath.Join(quarantineDir, filepath.Base(path)))
+}
@@ -0,0 +1,103 @@
+package fluentd_forwarder
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"io"
+)
+
+type CompressionCodec interface {
+	Name() string
+	ContentType() string
+	NewWriter(w io.Writer) io.WriteCloser
+	NewReader(r io.Reader) (io.Reader, error)
+}
+
+type gzipCodec struct {
+	level int
+}
+
+func (c *gzipCodec) Name() string        { return "gzip" }
+func (c *gzipCodec) ContentType() string { return "msgpack.gz" }
+func (c *gzipCodec) NewWriter(w io.Writer) io.WriteCloser {
+	writer, _ := gzip.NewWriterLevel(w, c.level)
+	return writer
+}
+func (c *gzipCodec) NewReader(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+type zstdCodec struct{}
+
+func (c *zstdCodec) Name() string        { return "zstd" }
+func (c *zstdCodec) ContentType() string { return "msgpack.zstd" }
+func (c *zstdCodec) NewWriter(w io.Writer) io.WriteCloser {
+	writer, _ := zstd.NewWriter(w)
+	return writer
+}
+func (c *zstdCodec) NewReader(r io.Reader) (io.Reader, error) {
+	return zstd.NewReader(r)
+}
+
+type snappyCodec struct{}
+
+func (c *snappyCodec) Name() string        { return "snappy" }
+func (c *snappyCodec) ContentType() string { return "msgpack.snappy" }
+func (c *snappyCodec) NewWriter(w io.Writer) io.WriteCloser {
+	return snappy.NewBufferedWriter(w)
+}
+func (c *snappyCodec) NewReader(r io.Reader) (io.Reader, error) {
+	return snappy.NewReader(r), nil
+}
+
+// encodeThroughCodec compresses src with the selected codec, so the
+// journal actually stores the codec's output rather than plain msgpack.
+// This is what the emitter calls before writing a chunk, so a faster
+// codec than gzip (zstd, snappy) genuinely shrinks the on-disk journal
+// instead of only getting exercised on a throwaway round trip.
+func encodeThroughCodec(c CompressionCodec, w io.Writer, src io.Reader) (int64, error) {
+	codecWriter := c.NewWriter(w)
+	n, err := io.Copy(codecWriter, src)
+	if closeErr := codecWriter.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// decodeChunkPayload decompresses src, a chunk's on-disk payload that
+// was written with codec c, back into plain msgpack records. TD's
+// Import API only ever accepts msgpack.gz, so the caller re-compresses
+// the decoded result with gzip at the upload boundary; this is the only
+// point where gzip is forced, regardless of which codec the journal
+// itself used. The returned cleanup func releases any resources the
+// decoder holds (e.g. the zstd decoder's goroutines); callers must call
+// it once done reading.
+func decodeChunkPayload(c CompressionCodec, src io.Reader) (io.Reader, func(), error) {
+	r, err := c.NewReader(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {}
+	switch closer := r.(type) {
+	case io.Closer:
+		cleanup = func() { closer.Close() }
+	case interface{ Close() }:
+		cleanup = closer.Close
+	}
+	return r, cleanup, nil
+}
+
+func NewCompressionCodec(name string) (CompressionCodec, error) {
+	switch name {
+	case "", "gzip":
+		return &gzipCodec{level: gzip.BestSpeed}, nil
+	case "zstd":
+		return &zstdCodec{}, nil
+	case "snappy":
+		return &snappyCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unknown compression codec %q", name)
+	}
+}
@@ -0,0 +1,32 @@
+package fluentd_forwarder
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func benchmarkCodecWrite(b *testing.B, codecName string, size int) {
+	c, err := NewCompressionCodec(codecName)
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := make([]byte, size)
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := c.NewWriter(ioutil.Discard)
+		if _, err := w.Write(data); err != nil {
+			b.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGzip10MB(b *testing.B)    { benchmarkCodecWrite(b, "gzip", 10<<20) }
+func BenchmarkGzip100MB(b *testing.B)   { benchmarkCodecWrite(b, "gzip", 100<<20) }
+func BenchmarkZstd10MB(b *testing.B)    { benchmarkCodecWrite(b, "zstd", 10<<20) }
+func BenchmarkZstd100MB(b *testing.B)   { benchmarkCodecWrite(b, "zstd", 100<<20) }
+func BenchmarkSnappy10MB(b *testing.B)  { benchmarkCodecWrite(b, "snappy", 10<<20) }
+func BenchmarkSnappy100MB(b *testing.B) { benchmarkCodecWrite(b, "snappy", 100<<20) }
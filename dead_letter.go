@@ -0,0 +1,136 @@
+package fluentd_forwarder
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DeadLetterJournal holds chunks that permanently failed to import so
+// that an operator can inspect or re-enqueue them later instead of
+// losing the data silently.
+type DeadLetterJournal struct {
+	dir     string
+	mtx     sync.Mutex
+	factory TempFileRandomAccessStoreFactory
+}
+
+// NewDeadLetterJournal creates the dead-letter directory (if it does
+// not already exist) and returns a journal rooted there.
+func NewDeadLetterJournal(dir string) (*DeadLetterJournal, error) {
+	if err := os.MkdirAll(dir, os.FileMode(0750)); err != nil {
+		return nil, err
+	}
+	return &DeadLetterJournal{
+		dir:     dir,
+		factory: TempFileRandomAccessStoreFactory{dir, "dead-"},
+	}, nil
+}
+
+func (j *DeadLetterJournal) pathFor(databaseName, tableName string, chunk JournalChunk) string {
+	return filepath.Join(j.dir, fmt.Sprintf("%s.%s.%s.log", databaseName, tableName, chunk.Id()))
+}
+
+// Put copies chunk's contents into the dead-letter directory and, once
+// that write has durably succeeded, disposes of the original. The chunk
+// is identified by database, table and chunk id so that Reenqueue can
+// later route it back to the right spooler.
+func (j *DeadLetterJournal) Put(databaseName, tableName string, chunk JournalChunk) error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	path := j.pathFor(databaseName, tableName, chunk)
+	w, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(0640))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, chunk)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// The chunk was never durably written, so don't dispose it:
+		// the caller still has the original in the journal and can
+		// retry dead-lettering it later instead of losing it silently.
+		os.Remove(path)
+		return err
+	}
+	chunk.Dispose()
+	return nil
+}
+
+// DeadLetterEntry describes a single quarantined chunk file.
+type DeadLetterEntry struct {
+	Path         string
+	DatabaseName string
+	TableName    string
+}
+
+// List returns the set of chunks currently sitting in the dead-letter
+// directory, for use by admin tooling.
+func (j *DeadLetterJournal) List() ([]DeadLetterEntry, error) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	infos, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]DeadLetterEntry, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		databaseName, tableName, ok := splitDeadLetterName(info.Name())
+		if !ok {
+			continue
+		}
+		entries = append(entries, DeadLetterEntry{
+			Path:         filepath.Join(j.dir, info.Name()),
+			DatabaseName: databaseName,
+			TableName:    tableName,
+		})
+	}
+	return entries, nil
+}
+
+// splitDeadLetterName parses "<database>.<table>.<chunkId>.log" back
+// into its database and table components.
+func splitDeadLetterName(name string) (databaseName, tableName string, ok bool) {
+	fields := strings.SplitN(name, ".", 3)
+	if len(fields) < 3 {
+		return "", "", false
+	}
+	return fields[0], fields[1], true
+}
+
+// Reenqueue re-reads every chunk currently sitting in the dead-letter
+// directory and hands it to the spooler daemon as if it had just
+// arrived from the emitter, then removes it from the dead-letter
+// directory. It is invoked from TDOutput's admin entry point rather
+// than from the regular flush loop.
+func (daemon *tdOutputSpoolerDaemon) Reenqueue() (int, error) {
+	entries, err := daemon.output.deadLetterJournal.List()
+	if err != nil {
+		return 0, err
+	}
+	reenqueued := 0
+	for _, entry := range entries {
+		data, err := ioutil.ReadFile(entry.Path)
+		if err != nil {
+			return reenqueued, err
+		}
+		key := entry.DatabaseName + "." + entry.TableName
+		spooler := daemon.spawnSpooler(entry.DatabaseName, entry.TableName, key)
+		if err := spooler.journal.Write(data); err != nil {
+			return reenqueued, err
+		}
+		if err := os.Remove(entry.Path); err != nil {
+			return reenqueued, err
+		}
+		reenqueued++
+	}
+	return reenqueued, nil
+}
@@ -0,0 +1,251 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var flushDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type key struct {
+	database string
+	table    string
+}
+
+type histogram struct {
+	buckets []int64
+	sum     int64
+	count   int64
+}
+
+func newHistogram() *histogram {
+	return &histogram{buckets: make([]int64, len(flushDurationBuckets))}
+}
+
+func (h *histogram) observe(seconds float64) {
+	atomic.AddInt64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(seconds*1e9))
+	for i, le := range flushDurationBuckets {
+		if seconds <= le {
+			atomic.AddInt64(&h.buckets[i], 1)
+		}
+	}
+}
+
+type Registry struct {
+	mtx               sync.Mutex
+	chunksFlushed     map[key]*int64
+	chunksFailed      map[key]*int64
+	bytesUploaded     map[key]*int64
+	journalBacklog    map[key]*int64
+	flushDuration     map[key]*histogram
+	activeSpoolers    int64
+	emitterQueueDepth int64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		chunksFlushed:  make(map[key]*int64),
+		chunksFailed:   make(map[key]*int64),
+		bytesUploaded:  make(map[key]*int64),
+		journalBacklog: make(map[key]*int64),
+		flushDuration:  make(map[key]*histogram),
+	}
+}
+
+func (r *Registry) counter(m map[key]*int64, database, table string) *int64 {
+	k := key{database, table}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	c, ok := m[k]
+	if !ok {
+		c = new(int64)
+		m[k] = c
+	}
+	return c
+}
+
+func (r *Registry) hist(database, table string) *histogram {
+	k := key{database, table}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	h, ok := r.flushDuration[k]
+	if !ok {
+		h = newHistogram()
+		r.flushDuration[k] = h
+	}
+	return h
+}
+
+func (r *Registry) IncChunksFlushed(database, table string) {
+	atomic.AddInt64(r.counter(r.chunksFlushed, database, table), 1)
+}
+
+func (r *Registry) IncChunksFailed(database, table string) {
+	atomic.AddInt64(r.counter(r.chunksFailed, database, table), 1)
+}
+
+func (r *Registry) AddBytesUploaded(database, table string, n int64) {
+	atomic.AddInt64(r.counter(r.bytesUploaded, database, table), n)
+}
+
+func (r *Registry) SetJournalBacklogBytes(database, table string, n int64) {
+	atomic.StoreInt64(r.counter(r.journalBacklog, database, table), n)
+}
+
+func (r *Registry) ObserveFlushDuration(database, table string, d time.Duration) {
+	r.hist(database, table).observe(d.Seconds())
+}
+
+func (r *Registry) SetActiveSpoolers(n int64) {
+	atomic.StoreInt64(&r.activeSpoolers, n)
+}
+
+func (r *Registry) SetEmitterQueueDepth(n int64) {
+	atomic.StoreInt64(&r.emitterQueueDepth, n)
+}
+
+type Snapshot struct {
+	ChunksFlushedTotal   map[string]int64   `json:"chunks_flushed_total"`
+	ChunksFailedTotal    map[string]int64   `json:"chunks_failed_total"`
+	BytesUploadedTotal   map[string]int64   `json:"bytes_uploaded_total"`
+	JournalBacklogBytes  map[string]int64   `json:"journal_backlog_bytes"`
+	FlushDurationCount   map[string]int64   `json:"flush_duration_seconds_count"`
+	FlushDurationSum     map[string]float64 `json:"flush_duration_seconds_sum"`
+	FlushDurationBuckets map[string][]int64 `json:"flush_duration_seconds_buckets"`
+	ActiveSpoolers       int64              `json:"active_spoolers"`
+	EmitterQueueDepth    int64              `json:"emitter_queue_depth"`
+}
+
+func labelKey(k key) string {
+	return fmt.Sprintf("%s.%s", k.database, k.table)
+}
+
+func (r *Registry) snapshot() Snapshot {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	s := Snapshot{
+		ChunksFlushedTotal:   make(map[string]int64, len(r.chunksFlushed)),
+		ChunksFailedTotal:    make(map[string]int64, len(r.chunksFailed)),
+		BytesUploadedTotal:   make(map[string]int64, len(r.bytesUploaded)),
+		JournalBacklogBytes:  make(map[string]int64, len(r.journalBacklog)),
+		FlushDurationCount:   make(map[string]int64, len(r.flushDuration)),
+		FlushDurationSum:     make(map[string]float64, len(r.flushDuration)),
+		FlushDurationBuckets: make(map[string][]int64, len(r.flushDuration)),
+		ActiveSpoolers:       atomic.LoadInt64(&r.activeSpoolers),
+		EmitterQueueDepth:    atomic.LoadInt64(&r.emitterQueueDepth),
+	}
+	for k, v := range r.chunksFlushed {
+		s.ChunksFlushedTotal[labelKey(k)] = atomic.LoadInt64(v)
+	}
+	for k, v := range r.chunksFailed {
+		s.ChunksFailedTotal[labelKey(k)] = atomic.LoadInt64(v)
+	}
+	for k, v := range r.bytesUploaded {
+		s.BytesUploadedTotal[labelKey(k)] = atomic.LoadInt64(v)
+	}
+	for k, v := range r.journalBacklog {
+		s.JournalBacklogBytes[labelKey(k)] = atomic.LoadInt64(v)
+	}
+	for k, h := range r.flushDuration {
+		lk := labelKey(k)
+		s.FlushDurationCount[lk] = atomic.LoadInt64(&h.count)
+		s.FlushDurationSum[lk] = float64(atomic.LoadInt64(&h.sum)) / 1e9
+		buckets := make([]int64, len(h.buckets))
+		for i := range h.buckets {
+			buckets[i] = atomic.LoadInt64(&h.buckets[i])
+		}
+		s.FlushDurationBuckets[lk] = buckets
+	}
+	return s
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (r *Registry) WritePrometheus(w http.ResponseWriter) {
+	s := r.snapshot()
+	writeCounter := func(name, help string, values map[string]int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, k := range sortedKeys(values) {
+			fmt.Fprintf(w, "%s{database_table=%q} %d\n", name, k, values[k])
+		}
+	}
+	writeGauge := func(name, help string, values map[string]int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for _, k := range sortedKeys(values) {
+			fmt.Fprintf(w, "%s{database_table=%q} %d\n", name, k, values[k])
+		}
+	}
+	writeCounter("chunks_flushed_total", "Chunks successfully imported into TD.", s.ChunksFlushedTotal)
+	writeCounter("chunks_failed_total", "Chunks that permanently failed to import.", s.ChunksFailedTotal)
+	writeCounter("bytes_uploaded_total", "Decoded msgpack bytes of successfully uploaded chunks (pre-gzip).", s.BytesUploadedTotal)
+	writeGauge("journal_backlog_bytes", "Bytes still sitting in the journal waiting to be flushed.", s.JournalBacklogBytes)
+	fmt.Fprintf(w, "# HELP flush_duration_seconds Time spent importing a chunk.\n# TYPE flush_duration_seconds histogram\n")
+	for _, k := range sortedKeys(s.FlushDurationCount) {
+		buckets := s.FlushDurationBuckets[k]
+		for i, le := range flushDurationBuckets {
+			fmt.Fprintf(w, "flush_duration_seconds_bucket{database_table=%q,le=%q} %d\n", k, fmt.Sprintf("%g", le), buckets[i])
+		}
+		fmt.Fprintf(w, "flush_duration_seconds_bucket{database_table=%q,le=\"+Inf\"} %d\n", k, s.FlushDurationCount[k])
+		fmt.Fprintf(w, "flush_duration_seconds_count{database_table=%q} %d\n", k, s.FlushDurationCount[k])
+		fmt.Fprintf(w, "flush_duration_seconds_sum{database_table=%q} %f\n", k, s.FlushDurationSum[k])
+	}
+	fmt.Fprintf(w, "# HELP active_spoolers Number of spoolers currently running.\n# TYPE active_spoolers gauge\nactive_spoolers %d\n", s.ActiveSpoolers)
+	fmt.Fprintf(w, "# HELP emitter_queue_depth Number of record sets buffered in the emitter channel.\n# TYPE emitter_queue_depth gauge\nemitter_queue_depth %d\n", s.EmitterQueueDepth)
+}
+
+func (r *Registry) WriteJSON(w http.ResponseWriter) error {
+	return json.NewEncoder(w).Encode(r.snapshot())
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/metrics.json":
+		w.Header().Set("Content-Type", "application/json")
+		r.WriteJSON(w)
+	default:
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WritePrometheus(w)
+	}
+}
+
+type Server struct {
+	registry *Registry
+	server   *http.Server
+}
+
+func NewServer(addr string, registry *Registry) *Server {
+	mux := http.NewServeMux()
+	s := &Server{registry: registry}
+	mux.Handle("/metrics", registry)
+	mux.Handle("/metrics.json", registry)
+	s.server = &http.Server{Addr: addr, Handler: mux}
+	return s
+}
+
+func (s *Server) Start() error {
+	if s.server.Addr == "" {
+		return nil
+	}
+	go s.server.ListenAndServe()
+	return nil
+}
+
+func (s *Server) Stop() error {
+	if s.server.Addr == "" {
+		return nil
+	}
+	return s.server.Close()
+}
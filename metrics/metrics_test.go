@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistrySnapshotAndPrometheus(t *testing.T) {
+	r := NewRegistry()
+	r.IncChunksFlushed("db", "tbl")
+	r.IncChunksFlushed("db", "tbl")
+	r.IncChunksFailed("db", "tbl")
+	r.AddBytesUploaded("db", "tbl", 1024)
+	r.SetJournalBacklogBytes("db", "tbl", 2048)
+	r.ObserveFlushDuration("db", "tbl", 30*time.Millisecond)
+	r.ObserveFlushDuration("db", "tbl", 2*time.Second)
+	r.SetActiveSpoolers(3)
+	r.SetEmitterQueueDepth(7)
+
+	snap := r.snapshot()
+	if got := snap.ChunksFlushedTotal["db.tbl"]; got != 2 {
+		t.Fatalf("ChunksFlushedTotal = %d, want 2", got)
+	}
+	if got := snap.ChunksFailedTotal["db.tbl"]; got != 1 {
+		t.Fatalf("ChunksFailedTotal = %d, want 1", got)
+	}
+	if got := snap.BytesUploadedTotal["db.tbl"]; got != 1024 {
+		t.Fatalf("BytesUploadedTotal = %d, want 1024", got)
+	}
+	if got := snap.JournalBacklogBytes["db.tbl"]; got != 2048 {
+		t.Fatalf("JournalBacklogBytes = %d, want 2048", got)
+	}
+
+	buckets := snap.FlushDurationBuckets["db.tbl"]
+	if len(buckets) != len(flushDurationBuckets) {
+		t.Fatalf("len(buckets) = %d, want %d", len(buckets), len(flushDurationBuckets))
+	}
+	// 30ms falls at or under every bucket; 2s only falls at or under buckets >= 2.5s.
+	if buckets[0] != 1 {
+		t.Fatalf("bucket[le=%g] = %d, want 1", flushDurationBuckets[0], buckets[0])
+	}
+	if buckets[len(buckets)-1] != 2 {
+		t.Fatalf("bucket[le=%g] = %d, want 2", flushDurationBuckets[len(buckets)-1], buckets[len(buckets)-1])
+	}
+
+	w := httptest.NewRecorder()
+	r.WritePrometheus(w)
+	body := w.Body.String()
+	if !strings.Contains(body, `flush_duration_seconds_bucket{database_table="db.tbl",le="+Inf"} 2`) {
+		t.Fatalf("missing +Inf bucket line in output:\n%s", body)
+	}
+	if !strings.Contains(body, `bytes_uploaded_total{database_table="db.tbl"} 1024`) {
+		t.Fatalf("missing bytes_uploaded_total line in output:\n%s", body)
+	}
+}
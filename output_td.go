@@ -3,9 +3,13 @@ package fluentd_forwarder
 import (
 	"bytes"
 	"github.com/ugorji/go/codec"
+	"github.com/catatsuy/fluentd-forwarder/metrics"
 	td_client "github.com/treasure-data/td-client-go"
 	logging "github.com/op/go-logging"
+	"fmt"
+	"math/rand"
 	"net"
+	"net/http"
 	"reflect"
 	"sync"
 	"sync/atomic"
@@ -14,9 +18,16 @@ import (
 	"unsafe"
 	"errors"
 	"compress/gzip"
+	"io"
+	"io/ioutil"
 	"strings"
 )
 
+// emitterChanSize buffers record sets between the emitter and whatever
+// calls Emit, so SetEmitterQueueDepth (driven by len(emitterChan)) can
+// actually report a backlog instead of always reading zero.
+const emitterChanSize = 256
+
 type tdOutputSpooler struct {
 	daemon       *tdOutputSpoolerDaemon
 	ticker       *time.Ticker
@@ -28,6 +39,7 @@ type tdOutputSpooler struct {
 	client       *td_client.TDClient
 	shutdownChan chan struct{}
 	isShuttingDown    unsafe.Pointer
+	backlogBytes int64
 }
 
 type tdOutputSpoolerDaemon struct {
@@ -36,16 +48,34 @@ type tdOutputSpoolerDaemon struct {
 	spoolersMtx  sync.Mutex
 	spoolers     map[string]*tdOutputSpooler
 	tempFactory  TempFileRandomAccessStoreFactory
+	coordinator  ChunkCoordinator
 	wg           sync.WaitGroup
 }
 
+// TDOutput satisfies Sink, so it can be subscribed alongside other sinks
+// behind a SubscriptionRouter.
+var _ Sink = (*TDOutput)(nil)
+
 type TDOutput struct {
 	logger            *logging.Logger
 	codec             *codec.MsgpackHandle
 	retryInterval     time.Duration
+	maxRetries        int
+	maxBackoff        time.Duration
 	databaseName      string
 	tableName         string
 	tempDir           string
+	journalGroupPath  string
+	deadLetterDir     string
+	deadLetterJournal *DeadLetterJournal
+	compressionCodec  CompressionCodec
+	metricsAddr       string
+	metrics           *metrics.Registry
+	metricsServer     *metrics.Server
+	adminAddr         string
+	adminServer       *http.Server
+	chunkCoordinator  ChunkCoordinator
+	chunkClaimTTL     time.Duration
 	enc               *codec.Encoder
 	conn              net.Conn
 	flushInterval     time.Duration
@@ -77,6 +107,132 @@ func (spooler *tdOutputSpooler) cleanup() {
 	spooler.daemon.wg.Done()
 }
 
+// isRetryableError reports whether err likely represents a transient
+// condition (timeouts, connection resets, 5xx/429 responses) worth
+// retrying, as opposed to a permanent failure such as bad credentials
+// or a malformed request. Deliberately does not match on "EOF": a bare
+// substring match there is indistinguishable from a local drained-reader
+// error, which would make a permanent local failure look retryable.
+func isRetryableError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if netErr, ok := err.(net.Error); ok {
+		if netErr.Timeout() {
+			return true
+		}
+	}
+	msg := err.Error()
+	for _, s := range []string{"500", "502", "503", "504", "429", "connection reset", "timeout"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// backoffDuration returns the delay before retry attempt n (0-based),
+// following initial*2^n with full jitter, capped at maxBackoff.
+func backoffDuration(initial, maxBackoff time.Duration, n int) time.Duration {
+	d := initial
+	for i := 0; i < n; i++ {
+		d *= 2
+		if d >= maxBackoff {
+			d = maxBackoff
+			break
+		}
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// chunkSnapshot wraps a JournalChunk (for Id/String/Dispose) together
+// with a single in-memory copy of its bytes, so dead-lettering gets its
+// own independent reader over data that importChunk's retries have
+// already (possibly repeatedly) read from separately. Without this, the
+// underlying chunk stream would be shared and drained by whichever
+// consumer reads it first.
+type chunkSnapshot struct {
+	JournalChunk
+	r *bytes.Reader
+}
+
+func newChunkSnapshot(chunk JournalChunk, data []byte) *chunkSnapshot {
+	return &chunkSnapshot{JournalChunk: chunk, r: bytes.NewReader(data)}
+}
+
+func (s *chunkSnapshot) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+// countingReader tracks how many bytes have been read through an
+// arbitrary io.Reader, used to report bytes_uploaded_total without
+// needing access to the compressing blob's internals.
+type countingReader struct {
+	src io.Reader
+	n   int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.src.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// importChunk uploads a chunk already fully buffered into data, so each
+// retry attempt reads its own fresh bytes.NewReader(data) instead of
+// sharing one drained stream across attempts (the chunk itself may have
+// only one real read available from the underlying journal). The journal
+// stores data compressed with output.compressionCodec, so it's decoded
+// back to plain msgpack here before being re-compressed to gzip, the
+// only format TD's Import endpoint accepts.
+func (spooler *tdOutputSpooler) importChunk(chunkId, chunkDesc string, data []byte) error {
+	output := spooler.daemon.output
+	const contentType = "msgpack.gz"
+	var lastErr error
+	start := time.Now()
+	for attempt := 0; attempt <= output.maxRetries; attempt++ {
+		if attempt > 0 {
+			wait := backoffDuration(output.retryInterval, output.maxBackoff, attempt-1)
+			output.logger.Notice("Retrying import of chunk %s in %s (attempt %d/%d)", chunkDesc, wait.String(), attempt, output.maxRetries)
+			time.Sleep(wait)
+		}
+		payload, cleanup, err := decodeChunkPayload(output.compressionCodec, newHeaderStrippingReader(bytes.NewReader(data)))
+		if err != nil {
+			lastErr = err
+			break
+		}
+		counting := &countingReader{src: payload}
+		_, err = spooler.client.Import(
+			spooler.databaseName,
+			spooler.tableName,
+			contentType,
+			NewCompressingBlob(
+				counting,
+				16777216,
+				gzip.BestSpeed,
+				&spooler.daemon.tempFactory,
+			),
+			chunkId,
+		)
+		cleanup()
+		if err == nil {
+			output.metrics.IncChunksFlushed(spooler.databaseName, spooler.tableName)
+			output.metrics.AddBytesUploaded(spooler.databaseName, spooler.tableName, counting.n)
+			output.metrics.ObserveFlushDuration(spooler.databaseName, spooler.tableName, time.Since(start))
+			return nil
+		}
+		lastErr = err
+		if !isRetryableError(err) {
+			break
+		}
+	}
+	output.metrics.IncChunksFailed(spooler.databaseName, spooler.tableName)
+	return lastErr
+}
+
 func (spooler *tdOutputSpooler) handle() {
 	defer spooler.cleanup()
 	spooler.daemon.output.logger.Notice("Spooler started")
@@ -84,22 +240,56 @@ func (spooler *tdOutputSpooler) handle() {
 		select {
 		case <-spooler.ticker.C:
 			spooler.daemon.output.logger.Notice("Flushing...")
-			err := spooler.journal.Flush(func(chunk JournalChunk) error {
-				defer chunk.Dispose()
-				spooler.daemon.output.logger.Info("Flushing chunk %s", chunk.String())
-				_, err := spooler.client.Import(
-					spooler.databaseName,
-					spooler.tableName,
-					"msgpack.gz",
-					NewCompressingBlob(
-						chunk,
-						16777216,
-						gzip.BestSpeed,
-						&spooler.daemon.tempFactory,
-					),
-					chunk.Id(),
-				)
-				return err
+			err := spooler.journal.Flush(func(rawChunk JournalChunk) error {
+				coordinator := spooler.daemon.coordinator
+				if coordinator != nil {
+					claimed, err := coordinator.Claim(rawChunk.Id(), spooler.daemon.output.chunkClaimTTL)
+					if err != nil {
+						return err
+					}
+					if !claimed {
+						spooler.daemon.output.logger.Notice("Discarding chunk %s: already claimed by a peer", rawChunk.String())
+						// Drain before disposing so the backlog gauge is
+						// decremented by the chunk's real size; otherwise
+						// a peer losing the claim race leaves the losing
+						// spooler's journal_backlog_bytes permanently
+						// inflated by data that's already gone.
+						n, _ := io.Copy(ioutil.Discard, rawChunk)
+						rawChunk.Dispose()
+						backlog := atomic.AddInt64(&spooler.backlogBytes, -n)
+						spooler.daemon.output.metrics.SetJournalBacklogBytes(spooler.databaseName, spooler.tableName, backlog)
+						return nil
+					}
+				}
+				// Buffer the chunk's bytes once: the underlying journal
+				// stream only has one real read available, so every
+				// retry attempt in importChunk and the dead-letter Put
+				// below each need their own independent reader over this
+				// same snapshot rather than re-reading rawChunk directly.
+				data, err := ioutil.ReadAll(rawChunk)
+				if err != nil {
+					return err
+				}
+				defer func() {
+					backlog := atomic.AddInt64(&spooler.backlogBytes, -int64(len(data)))
+					spooler.daemon.output.metrics.SetJournalBacklogBytes(spooler.databaseName, spooler.tableName, backlog)
+				}()
+				err = spooler.importChunk(rawChunk.Id(), rawChunk.String(), data)
+				if err != nil {
+					spooler.daemon.output.logger.Error("Permanently failed to import chunk %s: %s", rawChunk.String(), err.Error())
+					if dlErr := spooler.daemon.output.deadLetterJournal.Put(spooler.databaseName, spooler.tableName, newChunkSnapshot(rawChunk, data)); dlErr != nil {
+						spooler.daemon.output.logger.Error("Failed to dead-letter chunk %s: %s", rawChunk.String(), dlErr.Error())
+						return dlErr
+					}
+					return nil
+				}
+				if coordinator != nil {
+					if ackErr := coordinator.Ack(rawChunk.Id()); ackErr != nil {
+						spooler.daemon.output.logger.Error("Failed to ack chunk %s: %s", rawChunk.String(), ackErr.Error())
+					}
+				}
+				rawChunk.Dispose()
+				return nil
 			})
 			if err != nil {
 				spooler.daemon.output.logger.Error("Error during reading from the journal: %s", err.Error())
@@ -161,6 +351,7 @@ func (daemon *tdOutputSpoolerDaemon) spawnSpooler(databaseName, tableName, key s
 	daemon.output.logger.Notice("Spawning spooler " + spooler.key)
 	daemon.spoolers[spooler.key] = spooler
 	daemon.wg.Add(1)
+	daemon.output.metrics.SetActiveSpoolers(int64(len(daemon.spoolers)))
 	go spooler.handle()
 	return spooler
 }
@@ -181,6 +372,9 @@ func (daemon *tdOutputSpoolerDaemon) cleanup() {
 
 func (daemon *tdOutputSpoolerDaemon) handle() {
 	defer daemon.cleanup();
+	if err := daemon.Recover(daemon.output.journalGroupPath); err != nil {
+		daemon.output.logger.Error("Failed to recover journal directory %s: %s", daemon.output.journalGroupPath, err.Error())
+	}
 	daemon.output.logger.Notice("Spooler daemon started")
 	outer: for {
 		select {
@@ -197,6 +391,7 @@ func newTDOutputSpoolerDaemon(output *TDOutput) *tdOutputSpoolerDaemon {
 		shutdownChan: make(chan struct{}, 1),
 		spoolers: make(map[string]*tdOutputSpooler),
 		tempFactory: TempFileRandomAccessStoreFactory { output.tempDir, "", },
+		coordinator: output.chunkCoordinator,
 		wg: sync.WaitGroup {},
 	}
 }
@@ -252,6 +447,7 @@ func (output *TDOutput) spawnEmitter() {
 		output.logger.Notice("Emitter started")
 		buffer := bytes.Buffer{}
 		for recordSet := range output.emitterChan {
+			output.metrics.SetEmitterQueueDepth(int64(len(output.emitterChan)))
 			buffer.Reset()
 			encoder := codec.NewEncoder(&buffer, output.codec)
 			err := func() error {
@@ -264,7 +460,33 @@ func (output *TDOutput) spawnEmitter() {
 					return err
 				}
 				output.logger.Debug("Emitter processed %d entries", len(recordSet.Records))
-				return spooler.journal.Write(buffer.Bytes())
+				minTs, maxTs := timestampRange(recordSet.Records)
+				payload := bytes.Buffer{}
+				if _, err := encodeThroughCodec(output.compressionCodec, &payload, bytes.NewReader(buffer.Bytes())); err != nil {
+					return err
+				}
+				header := NewChunkHeader(
+					spooler.databaseName,
+					spooler.tableName,
+					int64(len(recordSet.Records)),
+					minTs,
+					maxTs,
+					int64(buffer.Len()),
+					int64(payload.Len()),
+					output.compressionCodec.Name(),
+				)
+				framed := bytes.Buffer{}
+				if err := WriteChunkHeader(&framed, header); err != nil {
+					return err
+				}
+				framed.Write(payload.Bytes())
+				frameBytes := framed.Bytes()
+				if err := spooler.journal.Write(frameBytes); err != nil {
+					return err
+				}
+				backlog := atomic.AddInt64(&spooler.backlogBytes, int64(len(frameBytes)))
+				output.metrics.SetJournalBacklogBytes(spooler.databaseName, spooler.tableName, backlog)
+				return nil
 			}()
 			if err != nil {
 				output.logger.Error("%s", err.Error())
@@ -292,6 +514,10 @@ func (output *TDOutput) String() string {
 func (output *TDOutput) Stop() {
 	if atomic.CompareAndSwapPointer(&output.isShuttingDown, unsafe.Pointer(uintptr(0)), unsafe.Pointer(uintptr(1))) {
 		close(output.emitterChan)
+		output.metricsServer.Stop()
+		if output.adminServer != nil {
+			output.adminServer.Close()
+		}
 	}
 }
 
@@ -299,15 +525,47 @@ func (output *TDOutput) WaitForShutdown() {
 	output.wg.Wait()
 }
 
+// handleReenqueue re-enqueues every dead-lettered chunk back onto its
+// spooler's journal, giving operators a way to recover from a permanent
+// import failure without restarting the process.
+func (output *TDOutput) handleReenqueue(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n, err := output.spoolerDaemon.Reenqueue()
+	if err != nil {
+		output.logger.Error("Failed to reenqueue dead-lettered chunks: %s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "reenqueued %d chunk(s)\n", n)
+}
+
+func (output *TDOutput) spawnAdminServer() {
+	if output.adminAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/reenqueue", output.handleReenqueue)
+	output.adminServer = &http.Server{Addr: output.adminAddr, Handler: mux}
+	output.logger.Notice("Spawning admin server on %s", output.adminAddr)
+	go output.adminServer.ListenAndServe()
+}
+
 func (output *TDOutput) Start() {
+	output.metricsServer.Start()
 	output.spawnEmitter()
 	output.spawnSpoolerDaemon()
+	output.spawnAdminServer()
 }
 
 func NewTDOutput(
 	logger *logging.Logger,
 	endpoint string,
 	retryInterval time.Duration,
+	maxRetries int,
+	maxBackoff time.Duration,
 	connectionTimeout time.Duration,
 	writeTimeout time.Duration,
 	flushInterval time.Duration,
@@ -317,6 +575,12 @@ func NewTDOutput(
 	databaseName string,
 	tableName string,
 	tempDir string,
+	deadLetterDir string,
+	compressionCodecName string,
+	metricsAddr string,
+	adminAddr string,
+	chunkCoordinator ChunkCoordinator,
+	chunkClaimTTL time.Duration,
 	useSsl bool,
 	httpProxy string,
 ) (*TDOutput, error) {
@@ -353,18 +617,39 @@ func NewTDOutput(
 	if err != nil {
 		return nil, err
 	}
+	deadLetterJournal, err := NewDeadLetterJournal(deadLetterDir)
+	if err != nil {
+		return nil, err
+	}
+	compressionCodec, err := NewCompressionCodec(compressionCodecName)
+	if err != nil {
+		return nil, err
+	}
+	metricsRegistry := metrics.NewRegistry()
 	output := &TDOutput{
 		logger:            logger,
 		codec:             &_codec,
 		retryInterval:     retryInterval,
+		maxRetries:        maxRetries,
+		maxBackoff:        maxBackoff,
 		wg:                sync.WaitGroup{},
 		flushInterval:     flushInterval,
-		emitterChan:       make(chan FluentRecordSet),
+		emitterChan:       make(chan FluentRecordSet, emitterChanSize),
 		isShuttingDown:    unsafe.Pointer(uintptr(0)),
 		client:            client,
 		databaseName:      databaseName,
 		tableName:         tableName,
 		tempDir:           tempDir,
+		journalGroupPath:  journalGroupPath,
+		deadLetterDir:     deadLetterDir,
+		deadLetterJournal: deadLetterJournal,
+		compressionCodec:  compressionCodec,
+		metricsAddr:       metricsAddr,
+		metrics:           metricsRegistry,
+		metricsServer:     metrics.NewServer(metricsAddr, metricsRegistry),
+		adminAddr:         adminAddr,
+		chunkCoordinator:  chunkCoordinator,
+		chunkClaimTTL:     chunkClaimTTL,
 	}
 	journalGroup, err := journalFactory.GetJournalGroup(journalGroupPath, output)
 	if err != nil {
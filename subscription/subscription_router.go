@@ -0,0 +1,169 @@
+// Package subscription implements a multicast router that sits in
+// front of an emitter channel and fans record sets out to an ordered
+// list of registered sinks, each with its own tag glob, sampling and
+// backpressure policy.
+package subscription
+
+import (
+	fluentd_forwarder "github.com/catatsuy/fluentd-forwarder"
+	logging "github.com/op/go-logging"
+	"math/rand"
+	"strings"
+	"sync"
+)
+
+// Sink is satisfied structurally by anything that can receive emitted
+// record sets (e.g. TDOutput), so this package doesn't need to import
+// fluentd_forwarder's own Sink type to target one.
+type Sink interface {
+	String() string
+	Emit(recordSets []fluentd_forwarder.FluentRecordSet) error
+	Start()
+	Stop()
+	WaitForShutdown()
+}
+
+type DropPolicy int
+
+const (
+	PolicyBlock DropPolicy = iota
+	PolicyDrop
+)
+
+type Subscription struct {
+	Sink         Sink
+	TagGlob      string
+	SampleRate   float64
+	Policy       DropPolicy
+	ch           chan fluentd_forwarder.FluentRecordSet
+	shutdownChan chan struct{}
+}
+
+func matchTagGlob(glob, tag string) bool {
+	if glob == "*" || glob == "" {
+		return true
+	}
+	if strings.HasSuffix(glob, ".*") {
+		prefix := glob[:len(glob)-1]
+		return strings.HasPrefix(tag, prefix)
+	}
+	return glob == tag
+}
+
+func (sub *Subscription) accepts(tag string) bool {
+	if !matchTagGlob(sub.TagGlob, tag) {
+		return false
+	}
+	if sub.SampleRate >= 1 {
+		return true
+	}
+	return rand.Float64() < sub.SampleRate
+}
+
+// offer is called concurrently with Stop(), so a send below can race a
+// shutdown that closes sub.shutdownChan; it never closes sub.ch itself
+// (see Stop), so there's nothing here that can panic on a closed-channel
+// send, but the recover still guards against it, the same way
+// TDOutput.Emit guards its own send to emitterChan.
+func (sub *Subscription) offer(router *SubscriptionRouter, recordSet fluentd_forwarder.FluentRecordSet) {
+	defer func() {
+		recover()
+	}()
+	switch sub.Policy {
+	case PolicyDrop:
+		select {
+		case sub.ch <- recordSet:
+		case <-sub.shutdownChan:
+		default:
+			router.logger.Warning("Dropping record set for tag %s: subscription to %s is full", recordSet.Tag, sub.Sink.String())
+		}
+	default:
+		select {
+		case sub.ch <- recordSet:
+		case <-sub.shutdownChan:
+		}
+	}
+}
+
+// handle drains sub.ch until Stop() closes sub.shutdownChan, rather than
+// ranging over sub.ch directly, since sub.ch is never closed: a send
+// racing a close would panic, so shutdown is signaled via shutdownChan
+// instead.
+func (sub *Subscription) handle(router *SubscriptionRouter) {
+	defer router.wg.Done()
+	for {
+		select {
+		case recordSet := <-sub.ch:
+			if err := sub.Sink.Emit([]fluentd_forwarder.FluentRecordSet{recordSet}); err != nil {
+				router.logger.Error("Sink %s failed to emit: %s", sub.Sink.String(), err.Error())
+			}
+		case <-sub.shutdownChan:
+			return
+		}
+	}
+}
+
+type SubscriptionRouter struct {
+	logger        *logging.Logger
+	subscriptions []*Subscription
+	wg            sync.WaitGroup
+}
+
+func NewSubscriptionRouter(logger *logging.Logger) *SubscriptionRouter {
+	return &SubscriptionRouter{
+		logger: logger,
+	}
+}
+
+func (router *SubscriptionRouter) Subscribe(sink Sink, tagGlob string, sampleRate float64, policy DropPolicy, bufferSize int) *Subscription {
+	sub := &Subscription{
+		Sink:         sink,
+		TagGlob:      tagGlob,
+		SampleRate:   sampleRate,
+		Policy:       policy,
+		ch:           make(chan fluentd_forwarder.FluentRecordSet, bufferSize),
+		shutdownChan: make(chan struct{}),
+	}
+	router.subscriptions = append(router.subscriptions, sub)
+	return sub
+}
+
+func (router *SubscriptionRouter) Emit(recordSets []fluentd_forwarder.FluentRecordSet) error {
+	defer func() {
+		recover()
+	}()
+	for _, recordSet := range recordSets {
+		for _, sub := range router.subscriptions {
+			if sub.accepts(recordSet.Tag) {
+				sub.offer(router, recordSet)
+			}
+		}
+	}
+	return nil
+}
+
+func (router *SubscriptionRouter) String() string {
+	return "subscription_router"
+}
+
+func (router *SubscriptionRouter) Start() {
+	for _, sub := range router.subscriptions {
+		sub.Sink.Start()
+		router.wg.Add(1)
+		go sub.handle(router)
+	}
+}
+
+func (router *SubscriptionRouter) Stop() {
+	for _, sub := range router.subscriptions {
+		sub.Sink.Stop()
+		close(sub.shutdownChan)
+	}
+}
+
+func (router *SubscriptionRouter) WaitForShutdown() {
+	for _, sub := range router.subscriptions {
+		sub.Sink.WaitForShutdown()
+	}
+	router.wg.Wait()
+}
@@ -0,0 +1,85 @@
+package subscription
+
+import (
+	fluentd_forwarder "github.com/catatsuy/fluentd-forwarder"
+	logging "github.com/op/go-logging"
+	"sync"
+	"testing"
+	"time"
+)
+
+type stubSink struct {
+	mtx     sync.Mutex
+	name    string
+	emitted []fluentd_forwarder.FluentRecordSet
+}
+
+func (s *stubSink) String() string { return s.name }
+
+func (s *stubSink) Emit(recordSets []fluentd_forwarder.FluentRecordSet) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.emitted = append(s.emitted, recordSets...)
+	return nil
+}
+
+func (s *stubSink) Start()           {}
+func (s *stubSink) Stop()            {}
+func (s *stubSink) WaitForShutdown() {}
+
+func (s *stubSink) count() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return len(s.emitted)
+}
+
+func TestSubscriptionRouterFansOutByTagGlob(t *testing.T) {
+	router := NewSubscriptionRouter(logging.MustGetLogger("test"))
+	access := &stubSink{name: "access"}
+	everything := &stubSink{name: "everything"}
+	router.Subscribe(access, "access.*", 1, PolicyBlock, 16)
+	router.Subscribe(everything, "*", 1, PolicyBlock, 16)
+	router.Start()
+	defer router.Stop()
+
+	if err := router.Emit([]fluentd_forwarder.FluentRecordSet{{Tag: "access.web"}, {Tag: "billing.invoice"}}); err != nil {
+		t.Fatalf("Emit failed: %v", err)
+	}
+
+	deadline := time.After(time.Second)
+	for access.count() < 1 || everything.count() < 2 {
+		select {
+		case <-deadline:
+			t.Fatalf("timed out waiting for fan-out: access=%d everything=%d", access.count(), everything.count())
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestSubscriptionRouterStopDoesNotPanicOnConcurrentEmit(t *testing.T) {
+	router := NewSubscriptionRouter(logging.MustGetLogger("test"))
+	sink := &stubSink{name: "sink"}
+	router.Subscribe(sink, "*", 1, PolicyDrop, 1)
+	router.Start()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				router.Emit([]fluentd_forwarder.FluentRecordSet{{Tag: "x"}})
+			}
+		}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	router.Stop()
+	close(stop)
+	wg.Wait()
+	router.WaitForShutdown()
+}